@@ -0,0 +1,147 @@
+package salvage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+const zip64ExtraID = 0x0001
+
+// HasZip64Extra reports whether a local file header's extra field contains
+// a zip64 extended information record (tag 0x0001), which is the only
+// reliable signal that a size field set to 0xffffffff is really stored as
+// 64 bits, independent of whatever "version needed to extract" says.
+func HasZip64Extra(extra []byte) bool {
+	b := ReadBuf(extra)
+
+	for len(b) >= 4 {
+		id := b.Uint16()
+		size := b.Uint16()
+
+		if int(size) > len(b) {
+			return false
+		}
+
+		if id == zip64ExtraID {
+			return true
+		}
+
+		b = b[size:]
+	}
+
+	return false
+}
+
+// Descriptor holds a data descriptor's three fields, whichever width they
+// were encoded in.
+type Descriptor struct {
+	CRC32              uint32
+	CompressedSize64   uint64
+	UncompressedSize64 uint64
+}
+
+// ReadDataDescriptor reads the optional trailing data descriptor that
+// follows an entry's compressed data when bit 3 of the general-purpose
+// flag is set.
+//
+// The 12- vs 20-byte question (32- vs 64-bit size fields) can't be
+// answered from "version needed to extract" alone: some zip64 producers
+// write version=20 in the local header while still emitting 8-byte
+// descriptor fields, and some that do claim version 4.5 fall back to
+// 4-byte fields once the real sizes turn out to fit. HasZip64Extra, a
+// presence of a zip64 extra field in the local header, is a much better
+// signal; when it disagrees with version, or there's no extra field to
+// consult, both 12- and 20-byte interpretations are tried and whichever
+// one reproduces the CRC32 we computed while decoding wins. If neither
+// does (or there's nothing to check them against), the result is
+// ambiguous and reported as an error rather than silently guessed at.
+func ReadDataDescriptor(r *bufio.Reader, version uint16, zip64Extra bool, computedCRC uint32, haveComputedCRC bool, debug bool) (Descriptor, error) {
+	// up to 4 bytes for the optional signature plus up to 20 bytes for the
+	// widest (zip64) descriptor
+	const maxLen = 4 + dataDescriptor64Len
+
+	buf, err := r.Peek(maxLen)
+	if err != nil && len(buf) < dataDescriptorLen {
+		return Descriptor{}, fmt.Errorf("data descriptor: %w", err)
+	}
+
+	offset := 0
+	if len(buf) >= 4 {
+		sig := ReadBuf(buf[0:4])
+		if sig.Uint32() == dataDescriptorSignature {
+			offset = 4
+		}
+	}
+
+	// order candidate widths by how much we trust the available signal,
+	// most trustworthy first
+	var order []int
+	switch {
+	case zip64Extra:
+		order = []int{dataDescriptor64Len, dataDescriptorLen}
+	case version >= zipVersion45:
+		order = []int{dataDescriptor64Len, dataDescriptorLen}
+	default:
+		order = []int{dataDescriptorLen, dataDescriptor64Len}
+	}
+
+	var candidates []Descriptor
+	var widths []int
+
+	for _, dl := range order {
+		if offset+dl > len(buf) {
+			continue
+		}
+
+		d := parseDescriptor(buf[offset:offset+dl], dl)
+
+		if !haveComputedCRC || d.CRC32 == computedCRC {
+			// accept the first candidate that either matches the known
+			// CRC, or that we have no CRC to check it against
+			if _, err := r.Discard(offset + dl); err != nil {
+				return Descriptor{}, err
+			}
+
+			if debug {
+				fmt.Println()
+				fmt.Printf("descriptor width %d bytes (zip64Extra=%v version=%d)\n", dl, zip64Extra, version)
+				fmt.Printf("crc32   %08x\n", d.CRC32)
+				fmt.Printf("compressed size   %d\n", d.CompressedSize64)
+				fmt.Printf("uncompressed size %d\n", d.UncompressedSize64)
+			}
+
+			return d, nil
+		}
+
+		candidates = append(candidates, d)
+		widths = append(widths, dl)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return Descriptor{}, errors.New("data descriptor: not enough data buffered to read it")
+	case 1:
+		return Descriptor{}, fmt.Errorf("data descriptor: the only readable (%d-byte) interpretation doesn't match the decompressed CRC32 %08x", widths[0], computedCRC)
+	default:
+		return Descriptor{}, fmt.Errorf("data descriptor: ambiguous, neither %d- nor %d-byte interpretation matches the decompressed CRC32 %08x", widths[0], widths[1], computedCRC)
+	}
+}
+
+func parseDescriptor(buf []byte, dl int) Descriptor {
+	b := ReadBuf(buf[:dl])
+
+	if dl == dataDescriptorLen {
+		return Descriptor{
+			CRC32:              b.Uint32(),
+			CompressedSize64:   uint64(b.Uint32()),
+			UncompressedSize64: uint64(b.Uint32()),
+		}
+	}
+
+	return Descriptor{
+		CRC32:              b.Uint32(),
+		CompressedSize64:   b.Uint64(),
+		UncompressedSize64: b.Uint64(),
+	}
+}
@@ -0,0 +1,41 @@
+package salvage
+
+import "encoding/binary"
+
+// from archive/zip struct.go
+
+const (
+	FileHeaderSignature       = 0x04034b50
+	DirectoryHeaderSignature  = 0x02014b50
+	dataDescriptorSignature   = 0x08074b50 // de-facto standard; required by OS X Finder
+	archiveExtraDataSignature = 0x08064b50
+	FileHeaderLen             = 30 // + filename + extra
+	dataDescriptorLen         = 12 // three uint32: crc32, compressed size, size (dataDescriptionSignature may not be there)
+	dataDescriptor64Len       = 20 // descriptor with 8 byte sizes
+
+	// version numbers
+	zipVersion20 = 20 // 2.0
+	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+)
+
+// ReadBuf is a little-endian cursor over a zip header's raw bytes, advancing
+// as each field is consumed. It mirrors archive/zip's internal readBuf.
+type ReadBuf []byte
+
+func (b *ReadBuf) Uint16() uint16 {
+	v := binary.LittleEndian.Uint16(*b)
+	*b = (*b)[2:]
+	return v
+}
+
+func (b *ReadBuf) Uint32() uint32 {
+	v := binary.LittleEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v
+}
+
+func (b *ReadBuf) Uint64() uint64 {
+	v := binary.LittleEndian.Uint64(*b)
+	*b = (*b)[8:]
+	return v
+}
@@ -0,0 +1,302 @@
+// Package salvage recovers file entries from damaged zip archives. It's
+// usable standalone as a library (see Salvage), and also backs zipsaver's
+// -cd/-scan/-out CLI modes.
+package salvage
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	crc32hash "hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Entry describes one file recovered by Salvage, regardless of whether it
+// came from the central directory or from the local-header scan.
+type Entry struct {
+	Name               string
+	Method             uint16
+	CRC32              uint32
+	CompressedSize64   uint64
+	UncompressedSize64 uint64
+	Modified           time.Time
+	Comment            string
+	ExternalAttrs      uint32
+
+	// Source is "cd" if the entry's metadata came from the central
+	// directory, or "scan" if it was recovered by the local-header scan
+	// because the central directory was missing, damaged, or failed CRC
+	// verification for this entry.
+	Source string
+}
+
+// Options controls how Salvage recovers entries.
+type Options struct {
+	Debug bool
+}
+
+// Salvage tries to recover as much of a damaged zip file as possible. It
+// first attempts to read the central directory the way archive/zip does
+// (tolerating zip64 EOCD locators and the pre-CL-6463050 16-bit
+// directoryRecords truncation); entries it can open and verify there keep
+// their true names, modification times, external attributes, and comments.
+// For anything the central directory can't locate, or whose data fails CRC
+// verification, Salvage falls back to the sequential local-header scan and
+// uses whatever it finds to fill the gap.
+func Salvage(r io.ReaderAt, size int64, opts Options) ([]Entry, error) {
+	good := map[string]Entry{}
+
+	if zr, err := zip.NewReader(r, size); err == nil {
+		for _, f := range zr.File {
+			if verifyCRC(f) {
+				good[f.Name] = Entry{
+					Name:               f.Name,
+					Method:             f.Method,
+					CRC32:              f.CRC32,
+					CompressedSize64:   f.CompressedSize64,
+					UncompressedSize64: f.UncompressedSize64,
+					Modified:           f.Modified,
+					Comment:            f.Comment,
+					ExternalAttrs:      f.ExternalAttrs,
+					Source:             "cd",
+				}
+			} else if opts.Debug {
+				log.Println("central directory entry failed verification, will rely on scan:", f.Name)
+			}
+		}
+	} else if opts.Debug {
+		log.Println("central directory unusable, falling back to scan:", err)
+	}
+
+	scanned, err := scanEntries(io.NewSectionReader(r, 0, size), opts)
+	if err != nil && len(good) == 0 && len(scanned) == 0 {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(good)+len(scanned))
+	for _, e := range good {
+		entries = append(entries, e)
+	}
+	for _, e := range scanned {
+		if _, ok := good[e.Name]; ok {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// verifyCRC reads f fully and compares its checksum against the central
+// directory's recorded CRC32, returning false if the entry can't even be
+// opened.
+func verifyCRC(f *zip.File) bool {
+	rc, err := f.Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	h := crc32hash.NewIEEE()
+	if _, err := io.Copy(h, rc); err != nil {
+		return false
+	}
+
+	return h.Sum32() == f.CRC32
+}
+
+// scanEntries walks r as a sequential stream of local file headers, exactly
+// like the legacy recovery loop in main, but only collects metadata instead
+// of writing file contents anywhere. It stops, and returns whatever entries
+// it collected along with a nil error, at a central directory signature or
+// a clean EOF between entries — both expected ways for a well-formed scan
+// to end. Anything else that stops it early (a header that isn't a valid
+// local file header, a truncated read, a decode failure) is a real problem
+// worth the caller knowing about, so it's returned as a non-nil error
+// alongside the entries collected so far.
+func scanEntries(r io.Reader, opts Options) ([]Entry, error) {
+	br := bufio.NewReader(r)
+
+	var entries []Entry
+
+	for {
+		var fh [FileHeaderLen]byte
+
+		if _, err := io.ReadFull(br, fh[:]); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return entries, fmt.Errorf("scan: truncated file header: %w", err)
+		}
+
+		b := ReadBuf(fh[:])
+		magic := b.Uint32()
+		version := b.Uint16()
+		flags := b.Uint16()
+		comp := b.Uint16()
+		ctime := b.Uint16()
+		cdate := b.Uint16()
+		crc32 := b.Uint32()
+		clen := uint64(b.Uint32())
+		ulen := uint64(b.Uint32())
+		flen := b.Uint16()
+		elen := b.Uint16()
+
+		if magic == DirectoryHeaderSignature {
+			return entries, nil
+		}
+
+		if magic != FileHeaderSignature {
+			if opts.Debug {
+				log.Printf("scan: invalid file header signature %08x", magic)
+			}
+			return entries, fmt.Errorf("scan: invalid file header signature %08x", magic)
+		}
+
+		fn := make([]byte, flen)
+		if _, err := io.ReadFull(br, fn); err != nil {
+			return entries, fmt.Errorf("scan: read file name: %w", err)
+		}
+
+		extra := make([]byte, elen)
+		if elen > 0 {
+			if _, err := io.ReadFull(br, extra); err != nil {
+				return entries, fmt.Errorf("scan: read extra field: %w", err)
+			}
+		}
+
+		filename := string(fn)
+
+		if comp == AEMethod {
+			// AES entries are self-delimiting via clen (the header's crc32
+			// is meaningless for AE-2, so it's not worth trying to decrypt
+			// here just to record one), so skip the ciphertext blob and
+			// keep scanning instead of aborting the whole recovery.
+			if clen == 0 {
+				if opts.Debug {
+					log.Println("scan: AES entry with unknown length (streamed data descriptor) is not supported, stopping")
+				}
+				return entries, errors.New("scan: AES entry with unknown length (streamed data descriptor) is not supported")
+			}
+
+			if _, err := io.CopyN(ioutil.Discard, br, int64(clen)); err != nil {
+				if opts.Debug {
+					log.Println("scan: skip AES entry", filename, err)
+				}
+				return entries, fmt.Errorf("scan: skip AES entry %s: %w", filename, err)
+			}
+
+			entries = append(entries, Entry{
+				Name:               filename,
+				Method:             AEMethod,
+				CRC32:              crc32,
+				CompressedSize64:   clen,
+				UncompressedSize64: ulen,
+				Modified:           msdosTime(cdate, ctime),
+				Source:             "scan",
+			})
+
+			continue
+		}
+
+		dcomp := Lookup(comp)
+		if dcomp == nil {
+			if opts.Debug {
+				log.Println("scan: unsupported compression mode", comp)
+			}
+			return entries, fmt.Errorf("scan: unsupported compression mode %d", comp)
+		}
+
+		var src io.Reader = br
+		if comp == zip.Store {
+			if ulen == 0 {
+				return entries, errors.New("scan: Stored entry with unknown length")
+			}
+			src = io.LimitReader(br, int64(ulen))
+		}
+
+		dec := dcomp(src)
+		h := crc32hash.NewIEEE()
+		n, err := io.Copy(h, dec)
+		dec.Close()
+		if err != nil {
+			if opts.Debug {
+				log.Println("scan: decode", filename, err)
+			}
+			return entries, fmt.Errorf("scan: decode %s: %w", filename, err)
+		}
+
+		computedCRC := h.Sum32()
+		if (flags & 0x08) != 0 {
+			ulen = uint64(n)
+			crc32 = computedCRC
+		}
+
+		if (flags & 0x08) != 0 {
+			d, err := ReadDataDescriptor(br, version, HasZip64Extra(extra), computedCRC, true, opts.Debug)
+			if err != nil {
+				if opts.Debug {
+					log.Println("scan:", err)
+				}
+				return entries, err
+			}
+
+			crc32 = d.CRC32
+			clen = d.CompressedSize64
+			ulen = d.UncompressedSize64
+		}
+
+		entries = append(entries, Entry{
+			Name:               filename,
+			Method:             comp,
+			CRC32:              crc32,
+			CompressedSize64:   clen,
+			UncompressedSize64: ulen,
+			Modified:           msdosTime(cdate, ctime),
+			Source:             "scan",
+		})
+	}
+}
+
+// MethodName renders a compression method the way -v does for the legacy
+// scan loop, so -cd output lines up with it.
+func MethodName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "Stored"
+	case zip.Deflate:
+		return "Defl:N"
+	case 12:
+		return "BZip2"
+	case 14:
+		return "LZMA"
+	case 93:
+		return "Zstd"
+	case 99:
+		return "AES"
+	default:
+		return "Unknown"
+	}
+}
+
+// msdosTime converts a DOS date/time pair, as stored in a local file
+// header, to a time.Time in the same way archive/zip does internally.
+func msdosTime(cdate, ctime uint16) time.Time {
+	year := int(cdate>>9) + 1980
+	month := int(cdate>>5) & 0xf
+	day := int(cdate & 0x1f)
+
+	hour := int(ctime >> 11)
+	min := int(ctime>>5) & 0x3f
+	sec := int(ctime&0x1f) * 2
+
+	if month == 0 || day == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, time.UTC)
+}
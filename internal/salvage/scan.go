@@ -0,0 +1,142 @@
+package salvage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"log"
+)
+
+var fileHeaderSignatureBytes = func() []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], FileHeaderSignature)
+	return b[:]
+}()
+
+// validMethods lists the compression methods the scanner accepts while
+// sanity-checking a resync candidate; it intentionally matches the methods
+// this tool knows how to handle (plus Store/Deflate's usual neighbours) so
+// a four-byte coincidence in garbage data doesn't get mistaken for a header.
+var validMethods = map[uint16]bool{
+	0:  true, // Store
+	1:  true, // Shrink
+	6:  true, // Implode
+	8:  true, // Deflate
+	9:  true, // Deflate64
+	12: true, // Bzip2
+	14: true, // LZMA
+	93: true, // Zstd
+	99: true, // AES
+}
+
+// Resync treats r as an opaque byte stream and searches forward for the
+// next local file header signature (PK\x03\x04), skipping over whatever
+// garbage precedes it: prepended SFX stubs, embedded zips, torn sectors, or
+// just corruption. It validates each candidate's header fields before
+// committing, so a stray four-byte coincidence doesn't get mistaken for a
+// real entry. On success, r is left positioned exactly at the signature of
+// a plausible header, ready for the normal header-parsing code to pick up.
+func Resync(r *bufio.Reader, debug bool) bool {
+	var skipped int64
+
+	for {
+		if !findSignature(r, &skipped) {
+			if debug {
+				log.Printf("resync: no more candidates (skipped %d bytes)", skipped)
+			}
+			return false
+		}
+
+		fh, err := r.Peek(FileHeaderLen)
+		if err != nil || !validCandidate(fh) {
+			if debug {
+				log.Println("resync: rejected candidate at skip offset", skipped)
+			}
+			// not a real header after all; step past this signature and
+			// keep looking
+			r.Discard(len(fileHeaderSignatureBytes))
+			skipped += int64(len(fileHeaderSignatureBytes))
+			continue
+		}
+
+		if debug {
+			log.Printf("resync: found header after skipping %d bytes of garbage", skipped)
+		} else {
+			log.Printf("resync: skipped %d bytes of garbage to find next entry", skipped)
+		}
+
+		return true
+	}
+}
+
+// findSignature advances r up to (not past) the next occurrence of the
+// local file header signature, counting how many bytes it skipped.
+// It reports false if the signature isn't found before EOF.
+func findSignature(r *bufio.Reader, skipped *int64) bool {
+	// Peek(n) fails with ErrBufferFull if n exceeds r's actual buffer
+	// capacity, so the window has to track that capacity rather than
+	// assume bufio.NewReader's default — otherwise a reader built with a
+	// smaller buffer makes this silently give up early, with no error, on
+	// anything beyond that smaller window.
+	window := r.Size()
+
+	for {
+		buf, err := r.Peek(window)
+
+		if idx := bytes.Index(buf, fileHeaderSignatureBytes); idx >= 0 {
+			r.Discard(idx)
+			*skipped += int64(idx)
+			return true
+		}
+
+		if len(buf) < len(fileHeaderSignatureBytes) {
+			return false
+		}
+
+		// keep the last few bytes buffered so a signature straddling this
+		// window boundary isn't missed
+		adv := len(buf) - (len(fileHeaderSignatureBytes) - 1)
+		r.Discard(adv)
+		*skipped += int64(adv)
+
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// validCandidate sanity-checks the fields of a would-be local file header
+// (not counting the signature itself) before we commit to treating it as a
+// real entry.
+func validCandidate(fh []byte) bool {
+	if len(fh) < FileHeaderLen {
+		return false
+	}
+
+	b := ReadBuf(fh[4:])
+	version := b.Uint16()
+	_ = b.Uint16() // flags
+	method := b.Uint16()
+	_ = b.Uint16() // time
+	_ = b.Uint16() // date
+	_ = b.Uint32() // crc32
+	_ = b.Uint32() // compressed size
+	_ = b.Uint32() // uncompressed size
+	flen := b.Uint16()
+	elen := b.Uint16()
+
+	if version > 63 {
+		return false
+	}
+	if !validMethods[method] {
+		return false
+	}
+	if flen == 0 || flen > 4096 {
+		return false
+	}
+	if elen > 4096 {
+		return false
+	}
+
+	return true
+}
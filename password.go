@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// passwordSource returns a function that lazily resolves the password for
+// encrypted entries: from -password, then -password-file, then an
+// interactive prompt, asked only once and cached for the rest of the run.
+func passwordSource(password, passwordFile string) func() ([]byte, error) {
+	var cached []byte
+	var resolved bool
+
+	return func() ([]byte, error) {
+		if resolved {
+			return cached, nil
+		}
+
+		resolved = true
+
+		switch {
+		case password != "":
+			cached = []byte(password)
+
+		case passwordFile != "":
+			data, err := ioutil.ReadFile(passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			cached = bytes.TrimRight(data, "\r\n")
+
+		default:
+			pass, err := promptPassword("Password: ")
+			if err != nil {
+				return nil, err
+			}
+			cached = pass
+		}
+
+		return cached, nil
+	}
+}
+
+// promptPassword asks the user for a password on the controlling terminal.
+// It tries to suppress echo so the password isn't shown; if that isn't
+// possible (e.g. stdin isn't a terminal), it falls back to a plain read.
+func promptPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	line, err := readPasswordNoEcho(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err == nil {
+		return line, nil
+	}
+
+	// this is a security-relevant fallback (the password will be echoed
+	// to the terminal as it's typed), so warn unconditionally rather than
+	// only under -debug
+	log.Println("password prompt: no-echo read unavailable, falling back to plain, echoed read:", err)
+
+	reader := bufio.NewReader(os.Stdin)
+	line, err = reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// termios mirrors Linux's struct termios (see asm-generic/termbits.h) for
+// the fields we need to toggle ECHO via TCGETS/TCSETS.
+type termios struct {
+	Iflag, Oflag, Cflag, Lflag uint32
+	Line                       uint8
+	Cc                         [19]uint8
+	Ispeed, Ospeed             uint32
+}
+
+const (
+	tcgets = 0x5401
+	tcsets = 0x5402
+	lEcho  = 0x00000008
+)
+
+// readPasswordNoEcho reads a single line from fd with terminal echo
+// disabled, the way a password prompt should behave. It returns an error
+// if fd isn't a terminal that supports this (e.g. input is piped).
+func readPasswordNoEcho(fd int) ([]byte, error) {
+	var oldState termios
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tcgets, uintptr(unsafe.Pointer(&oldState))); errno != 0 {
+		return nil, errno
+	}
+
+	newState := oldState
+	newState.Lflag &^= lEcho
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tcsets, uintptr(unsafe.Pointer(&newState))); errno != 0 {
+		return nil, errno
+	}
+
+	defer syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tcsets, uintptr(unsafe.Pointer(&oldState)))
+
+	reader := bufio.NewReader(os.NewFile(uintptr(fd), "/dev/stdin"))
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+)
+
+// readPasswordNoEcho reads a single line from fd with terminal echo
+// disabled. Rather than hand-rolling the termios layout and ioctl numbers
+// for every non-Linux platform (they differ by BSD variant), it shells out
+// to stty, which every platform zipsaver targets ships and which every
+// other interactive password prompt on these platforms relies on too.
+func readPasswordNoEcho(fd int) ([]byte, error) {
+	if err := exec.Command("stty", "-f", "/dev/tty", "-echo").Run(); err != nil {
+		return nil, err
+	}
+	defer exec.Command("stty", "-f", "/dev/tty", "echo").Run()
+
+	reader := bufio.NewReader(os.NewFile(uintptr(fd), "/dev/stdin"))
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
@@ -3,60 +3,34 @@ package main
 import (
 	"archive/zip"
 	"bufio"
-	"compress/flate"
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	crc32hash "hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
-)
-
-// from archive/zip struct.go
-
-const (
-	fileHeaderSignature       = 0x04034b50
-	directoryHeaderSignature  = 0x02014b50
-	dataDescriptorSignature   = 0x08074b50 // de-facto standard; required by OS X Finder
-	archiveExtraDataSignature = 0x08064b50
-	fileHeaderLen             = 30 // + filename + extra
-	dataDescriptorLen         = 12 // three uint32: crc32, compressed size, size (dataDescriptionSignature may not be there)
-	dataDescriptor64Len       = 20 // descriptor with 8 byte sizes
 
-	// version numbers
-	zipVersion20 = 20 // 2.0
-	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+	"github.com/raff/zipsaver/internal/salvage"
 )
 
-type readBuf []byte
-
-func (b *readBuf) uint16() uint16 {
-	v := binary.LittleEndian.Uint16(*b)
-	*b = (*b)[2:]
-	return v
-}
-
-func (b *readBuf) uint32() uint32 {
-	v := binary.LittleEndian.Uint32(*b)
-	*b = (*b)[4:]
-	return v
-}
-
-func (b *readBuf) uint64() uint64 {
-	v := binary.LittleEndian.Uint64(*b)
-	*b = (*b)[8:]
-	return v
-}
+// debugMode mirrors the -debug flag for helpers, like the password prompt,
+// that don't otherwise have access to it.
+var debugMode bool
 
 func main() {
 	debug := flag.Bool("debug", false, "print debug info")
 	view := flag.Bool("v", false, "view list")
 	out := flag.String("out", "", "write recovered files to output zip file")
 	override := flag.Bool("override", false, "override existing files")
+	cd := flag.Bool("cd", false, "try the central directory first, falling back to a local-header scan for what it can't recover")
+	scan := flag.Bool("scan", false, "resync past corrupted or unrecognized data instead of stopping at the first bad header")
+	password := flag.String("password", "", "password for WinZip AES encrypted entries")
+	passwordFile := flag.String("password-file", "", "file to read the password for WinZip AES encrypted entries from")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [options] {zip-file}\n", path.Base(os.Args[0]))
@@ -71,6 +45,9 @@ func main() {
 		return
 	}
 
+	debugMode = *debug
+	passwordProvider := passwordSource(*password, *passwordFile)
+
 	zipfile := flag.Arg(0)
 
 	f, err := os.Open(zipfile)
@@ -80,6 +57,29 @@ func main() {
 
 	defer f.Close()
 
+	if *cd {
+		fi, err := f.Stat()
+		if err != nil {
+			log.Fatal("stat ", err)
+		}
+
+		entries, err := salvage.Salvage(f, fi.Size(), salvage.Options{Debug: *debug})
+		if err != nil {
+			log.Fatal("salvage ", err)
+		}
+
+		for _, e := range entries {
+			pc := 0
+			if e.UncompressedSize64 != 0 {
+				pc = 100 - int(e.CompressedSize64*100/e.UncompressedSize64)
+			}
+			fmt.Printf("%8d  %6s  %8d  %2d%%  %08x  %-4s  %s\n",
+				e.UncompressedSize64, salvage.MethodName(e.Method), e.CompressedSize64, pc, e.CRC32, e.Source, e.Name)
+		}
+
+		return
+	}
+
 	r := bufio.NewReader(f)
 
 	var outz *zip.Writer
@@ -105,7 +105,7 @@ func main() {
 
 Loop:
 	for {
-		var fh [fileHeaderLen]byte
+		var fh [salvage.FileHeaderLen]byte
 
 		if _, err := io.ReadFull(r, fh[:]); err != nil {
 			log.Println("file header", err)
@@ -119,29 +119,34 @@ Loop:
 
 		var clen, ulen uint64
 
-		b := readBuf(fh[:])
-		magic := b.uint32()
-		version := b.uint16()
-		flags := b.uint16()
-		comp := b.uint16()
-		ctime := b.uint16()
-		cdate := b.uint16()
-		crc32 := b.uint32()
-		clen = uint64(b.uint32())
-		ulen = uint64(b.uint32())
-		flen := b.uint16()
-		elen := b.uint16()
+		b := salvage.ReadBuf(fh[:])
+		magic := b.Uint32()
+		version := b.Uint16()
+		flags := b.Uint16()
+		comp := b.Uint16()
+		ctime := b.Uint16()
+		cdate := b.Uint16()
+		crc32 := b.Uint32()
+		clen = uint64(b.Uint32())
+		ulen = uint64(b.Uint32())
+		flen := b.Uint16()
+		elen := b.Uint16()
 
 		ctype := ""
 
-		if magic == directoryHeaderSignature {
+		if magic == salvage.DirectoryHeaderSignature {
 			// got central directory. Done
 			log.Println("found central directory")
 			break Loop
 		}
 
-		if magic != fileHeaderSignature {
+		if magic != salvage.FileHeaderSignature {
 			log.Println("invalid file header signature ", fmt.Sprintf("%08x", magic))
+
+			if *scan && salvage.Resync(r, *debug) {
+				continue Loop
+			}
+
 			break Loop
 		}
 
@@ -209,8 +214,9 @@ Loop:
 			fmt.Println("filename", string(fn))
 		}
 
+		extra := make([]byte, elen)
 		if elen > 0 {
-			if _, err := io.CopyN(ioutil.Discard, r, int64(elen)); err != nil {
+			if _, err := io.ReadFull(r, extra); err != nil {
 				log.Println("read extra", err)
 				break Loop
 			}
@@ -218,9 +224,19 @@ Loop:
 
 		filename := string(fn)
 
-		switch comp {
-		case zip.Deflate:
-			ctype = "Defl:N"
+		// raw holds the exact compressed bytes read for this entry, captured
+		// as they're consumed so they can be replayed verbatim into outz via
+		// CreateRaw instead of being re-deflated.
+		var raw *bytes.Buffer
+
+		// computedCRC is the CRC32 of the data we actually decoded; when a
+		// trailing data descriptor follows, it's the one piece of ground
+		// truth we can use to tell a 12- and a 20-byte descriptor apart.
+		var computedCRC uint32
+		var haveComputedCRC bool
+
+		if comp == salvage.AEMethod {
+			ctype = "AES"
 
 			var w io.Writer
 
@@ -250,8 +266,16 @@ Loop:
 				}
 			}
 
-			dec := flate.NewReader(r)
-			n, err := io.Copy(w, dec)
+			if clen == 0 {
+				log.Fatal("AES entry with unknown length (streamed data descriptor) is not supported")
+			}
+
+			blob := make([]byte, clen)
+			if _, err := io.ReadFull(r, blob); err != nil {
+				log.Fatal("read AES entry ", filename, err)
+			}
+
+			n, err := salvage.DecryptAndInflate(w, blob, extra, passwordProvider)
 			if *debug {
 				fmt.Println("decoded", n, "bytes")
 			}
@@ -261,81 +285,151 @@ Loop:
 					os.Remove(filename)
 				}
 
-				log.Println("decode file", err)
+				log.Println("decode AES entry", err)
 				break Loop
-			} else {
-				dec.Close()
+			}
 
-				if wc, ok := w.(io.Closer); ok {
-					wc.Close()
-				}
+			if wc, ok := w.(io.Closer); ok {
+				wc.Close()
 			}
 
-		case zip.Store:
-			ctype = "Stored"
+			ulen = uint64(n)
+		} else if dcomp := salvage.Lookup(comp); dcomp != nil {
+			ctype = salvage.MethodName(comp)
+
+			var w io.Writer
+
+			if *view {
+				w = ioutil.Discard
+			} else if outz != nil {
+				raw = new(bytes.Buffer)
+				w = ioutil.Discard
+			} else {
+				fmt.Println("inflating:", filename)
 
-			if ulen > 0 {
-				n, err := io.CopyN(ioutil.Discard, r, int64(ulen))
-				if *debug {
-					fmt.Println("read", n, "bytes")
+				dir := filepath.Dir(filename)
+				if dir != "" {
+					if err := os.MkdirAll(dir, 0755); err != nil {
+						log.Println("mkdir", dir, err)
+					}
 				}
-				if err != nil {
-					log.Fatal("read file ", err)
+
+				if f, err := os.OpenFile(filename, create_flags, 0666); err != nil {
+					log.Fatal("create ", filename, err)
+				} else {
+					w = f
 				}
-			} else {
-				log.Fatal("missing length")
 			}
 
-		default:
-			log.Fatal("unsupported compression mode ", comp)
-		}
+			var src io.Reader = r
 
-		if (flags & 0x08) != 0 {
-			// data descriptor
-			var dd [dataDescriptor64Len]byte
+			if comp == zip.Store {
+				// Store isn't self-delimiting like the other methods, so we
+				// have to bound the read by the declared length ourselves
+				if ulen == 0 {
+					log.Fatal("missing length")
+				}
+				src = io.LimitReader(r, int64(ulen))
+			}
 
-			dl := dataDescriptorLen
-			if version >= zipVersion45 {
-				dl = dataDescriptor64Len
+			if raw != nil {
+				// tee the raw compressed stream into the buffer as the
+				// decompressor consumes it, so we learn exactly how many
+				// compressed bytes belong to this entry and can replay them
+				// verbatim into outz
+				src = io.TeeReader(src, raw)
 			}
 
-			if _, err := io.ReadFull(r, dd[0:4]); err != nil {
-				log.Fatal("data descriptor header", err)
+			dec := dcomp(src)
+			crcw := crc32hash.NewIEEE()
+			n, err := io.Copy(io.MultiWriter(w, crcw), dec)
+			if *debug {
+				fmt.Println("decoded", n, "bytes")
 			}
+			if err != nil {
+				if wc, ok := w.(io.Closer); ok {
+					wc.Close()
+					os.Remove(filename)
+				}
 
-			var hasMagic bool
+				log.Println("decode file", err)
+				break Loop
+			} else {
+				dec.Close()
+
+				if wc, ok := w.(io.Closer); ok {
+					wc.Close()
+				}
+			}
 
-			b := readBuf(dd[0:4])
-			if b.uint32() == dataDescriptorSignature {
-				hasMagic = true
+			computedCRC = crcw.Sum32()
+			haveComputedCRC = true
 
-				if _, err := io.ReadFull(r, dd[:dl]); err != nil {
-					log.Fatal("data descriptor", err)
+			if raw != nil {
+				// trust what we just recovered by decoding; the trailing data
+				// descriptor, if any, is read below and takes precedence when
+				// present
+				ulen = uint64(n)
+				clen = uint64(raw.Len())
+				crc32 = computedCRC
+			}
+		} else {
+			ctype = salvage.MethodName(comp)
+			log.Println("unsupported compression mode", comp, "- skipping entry", filename)
+
+			if clen == 0 {
+				// the entry is streamed with an unknown length (bit 3), so
+				// there's no way to know where its data ends without being
+				// able to decode it; the best we can do is resync past it
+				if *scan && salvage.Resync(r, *debug) {
+					continue Loop
 				}
-			} else if _, err := io.ReadFull(r, dd[4:dl-4]); err != nil {
-				log.Fatal("data descriptor", err)
+
+				log.Println("cannot locate the end of an unsupported streamed entry, stopping recovery")
+				break Loop
 			}
 
-			b = readBuf(dd[0:dl])
+			if _, err := io.CopyN(ioutil.Discard, r, int64(clen)); err != nil {
+				log.Println("skip entry", filename, err)
+				break Loop
+			}
+		}
 
-			if version < zipVersion45 {
-				crc32 = b.uint32()
-				clen = uint64(b.uint32())
-				ulen = uint64(b.uint32())
-			} else {
-				crc32 = b.uint32()
-				clen = b.uint64()
-				ulen = b.uint64()
+		if (flags & 0x08) != 0 {
+			d, err := salvage.ReadDataDescriptor(r, version, salvage.HasZip64Extra(extra), computedCRC, haveComputedCRC, *debug)
+			if err != nil {
+				log.Fatal(err)
 			}
 
-			if *debug {
-				fmt.Println()
-				if hasMagic {
-					fmt.Printf("magic   %08x\n", dataDescriptorSignature)
-				}
-				fmt.Printf("crc32   %08x\n", crc32)
-				fmt.Printf("compressed size   %d\n", clen)
-				fmt.Printf("uncompressed size %d\n", ulen)
+			crc32 = d.CRC32
+			clen = d.CompressedSize64
+			ulen = d.UncompressedSize64
+		}
+
+		if raw != nil {
+			fmt.Println("adding:", filename)
+
+			rfh := &zip.FileHeader{
+				Name: filename,
+				// preserve the original general-purpose flags, notably bit
+				// 11 (EFS, "filename is UTF-8"), so a recovered entry with
+				// a non-ASCII name doesn't get reinterpreted under the
+				// legacy code page; clear bit 3 (data descriptor follows),
+				// since CreateRaw writes the sizes directly above and no
+				// descriptor follows in the raw bytes we're about to write
+				Flags:              flags &^ 0x08,
+				Method:             comp,
+				CRC32:              crc32,
+				CompressedSize64:   clen,
+				UncompressedSize64: ulen,
+				ModifiedTime:       ctime,
+				ModifiedDate:       cdate,
+			}
+
+			if w, err := outz.CreateRaw(rfh); err != nil {
+				log.Fatal("create raw zip entry ", filename, err)
+			} else if _, err := w.Write(raw.Bytes()); err != nil {
+				log.Fatal("write raw zip entry ", filename, err)
 			}
 		}
 